@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const relaysBaseURL = "https://api.mullvad.net/www/relays/"
+
+// cacheEntry is the on-disk representation of a cached relay list, stored
+// under $XDG_CACHE_HOME/mullvad-best-server/relays-{type}.json.
+type cacheEntry struct {
+	FetchedAt    time.Time `json:"fetched_at"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Body         []byte    `json:"body"`
+}
+
+func getServers(serverType string, cacheTTL time.Duration, refresh bool, offline bool) (servers []*MullvadServerDTO) {
+	body := fetchRelaysBody(serverType, cacheTTL, refresh, offline)
+	if err := json.Unmarshal(body, &servers); err != nil {
+		log.Fatal().Err(err).Msg("couldn't unmarshall server json")
+	}
+	return
+}
+
+func fetchRelaysBody(serverType string, cacheTTL time.Duration, refresh bool, offline bool) []byte {
+	path, pathErr := cacheFilePath(serverType)
+	var cached *cacheEntry
+	if pathErr != nil {
+		log.Debug().Err(pathErr).Msg("Relay list cache unavailable")
+	} else if entry, err := loadCacheEntry(path); err == nil {
+		cached = entry
+	}
+
+	if offline {
+		if cached == nil {
+			log.Fatal().Msg("--offline was given but no cached relay list was found")
+		}
+		return cached.Body
+	}
+
+	if cached != nil && !refresh && time.Since(cached.FetchedAt) < cacheTTL {
+		log.Debug().Str("path", path).Msg("Using cached relay list")
+		return cached.Body
+	}
+
+	req, err := http.NewRequest(http.MethodGet, relaysBaseURL+serverType+"/", nil)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to build relays request")
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Error().Err(err).Msg("Mullvad API not responding, falling back to cache or local backup")
+		return fallbackRelaysBody(cached)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		cached.FetchedAt = time.Now()
+		if path != "" {
+			if err := saveCacheEntry(path, cached); err != nil {
+				log.Warn().Err(err).Msg("Failed to refresh relay list cache timestamp")
+			}
+		}
+		return cached.Body
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		log.Error().Int("status", resp.StatusCode).Msg("Unexpected response from Mullvad API, falling back to cache or local backup")
+		return fallbackRelaysBody(cached)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read the body, falling back to cache or local backup")
+		return fallbackRelaysBody(cached)
+	}
+
+	if path != "" {
+		entry := &cacheEntry{
+			FetchedAt:    time.Now(),
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Body:         body,
+		}
+		if err := saveCacheEntry(path, entry); err != nil {
+			log.Warn().Err(err).Msg("Failed to write relay list cache")
+		}
+	}
+	return body
+}
+
+func fallbackRelaysBody(cached *cacheEntry) []byte {
+	if cached != nil {
+		return cached.Body
+	}
+	body, err := os.ReadFile("wireguard_servers.json")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Can't find servers backup file")
+	}
+	return body
+}
+
+func cacheFilePath(serverType string) (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, "mullvad-best-server")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "relays-"+serverType+".json"), nil
+}
+
+func loadCacheEntry(path string) (*cacheEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func saveCacheEntry(path string, entry *cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
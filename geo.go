@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type cityCoordinates struct {
+	Lat float64
+	Lon float64
+}
+
+// cityCoordinatesByCode is a small static lookup from Mullvad's city_code to
+// approximate coordinates, used to pre-filter relays by great-circle
+// distance before pinging any of them.
+var cityCoordinatesByCode = map[string]cityCoordinates{
+	"sto": {59.3293, 18.0686},   // Stockholm, Sweden
+	"got": {57.7089, 11.9746},   // Gothenburg, Sweden
+	"mma": {55.6050, 13.0038},   // Malmo, Sweden
+	"osl": {59.9139, 10.7522},   // Oslo, Norway
+	"cph": {55.6761, 12.5683},   // Copenhagen, Denmark
+	"hel": {60.1699, 24.9384},   // Helsinki, Finland
+	"ams": {52.3676, 4.9041},    // Amsterdam, Netherlands
+	"bru": {50.8503, 4.3517},    // Brussels, Belgium
+	"lon": {51.5074, -0.1278},   // London, UK
+	"mnc": {53.4808, -2.2426},   // Manchester, UK
+	"par": {48.8566, 2.3522},    // Paris, France
+	"mrs": {43.2965, 5.3698},    // Marseille, France
+	"fra": {50.1109, 8.6821},    // Frankfurt, Germany
+	"ber": {52.5200, 13.4050},   // Berlin, Germany
+	"dus": {51.2277, 6.7735},    // Dusseldorf, Germany
+	"zrh": {47.3769, 8.5417},    // Zurich, Switzerland
+	"mil": {45.4642, 9.1900},    // Milan, Italy
+	"mad": {40.4168, -3.7038},   // Madrid, Spain
+	"bcn": {41.3851, 2.1734},    // Barcelona, Spain
+	"lis": {38.7223, -9.1393},   // Lisbon, Portugal
+	"vie": {48.2082, 16.3738},   // Vienna, Austria
+	"waw": {52.2297, 21.0122},   // Warsaw, Poland
+	"prg": {50.0755, 14.4378},   // Prague, Czech Republic
+	"buc": {44.4268, 26.1025},   // Bucharest, Romania
+	"sof": {42.6977, 23.3219},   // Sofia, Bulgaria
+	"ath": {37.9838, 23.7275},   // Athens, Greece
+	"ist": {41.0082, 28.9784},   // Istanbul, Turkey
+	"dub": {53.3498, -6.2603},   // Dublin, Ireland
+	"rey": {64.1466, -21.9426},  // Reykjavik, Iceland
+	"tll": {59.4370, 24.7536},   // Tallinn, Estonia
+	"rig": {56.9496, 24.1052},   // Riga, Latvia
+	"vno": {54.6872, 25.2797},   // Vilnius, Lithuania
+	"yyz": {43.6511, -79.3832},  // Toronto, Canada
+	"yyc": {51.0447, -114.0719}, // Calgary, Canada
+	"nyc": {40.7128, -74.0060},  // New York, USA
+	"atl": {33.7490, -84.3880},  // Atlanta, USA
+	"chi": {41.8781, -87.6298},  // Chicago, USA
+	"dal": {32.7767, -96.7970},  // Dallas, USA
+	"den": {39.7392, -104.9903}, // Denver, USA
+	"lax": {34.0522, -118.2437}, // Los Angeles, USA
+	"mia": {25.7617, -80.1918},  // Miami, USA
+	"sea": {47.6062, -122.3321}, // Seattle, USA
+	"slc": {40.7608, -111.8910}, // Salt Lake City, USA
+	"mex": {19.4326, -99.1332},  // Mexico City, Mexico
+	"sao": {-23.5505, -46.6333}, // Sao Paulo, Brazil
+	"san": {-33.4489, -70.6693}, // Santiago, Chile
+	"joh": {-26.2041, 28.0473},  // Johannesburg, South Africa
+	"sng": {1.3521, 103.8198},   // Singapore
+	"tyo": {35.6762, 139.6503},  // Tokyo, Japan
+	"syd": {-33.8688, 151.2093}, // Sydney, Australia
+	"hkg": {22.3193, 114.1694},  // Hong Kong
+}
+
+type serverDistance struct {
+	server   *MullvadServerDTO
+	distance float64
+}
+
+// filterByGeoProximity narrows servers down to the nearest candidates before
+// any pinging happens, using the caller's geolocation and each relay's
+// bundled city coordinates. It's a no-op unless nearest or maxDistanceKm is set.
+func filterByGeoProximity(servers []*MullvadServerDTO, nearest int, maxDistanceKm float64) []*MullvadServerDTO {
+	if nearest <= 0 && maxDistanceKm <= 0 {
+		return servers
+	}
+
+	lat, lon, err := callerLocation()
+	if err != nil {
+		log.Warn().Err(err).Msg("Couldn't determine caller location, skipping geo pre-filter")
+		return servers
+	}
+
+	distances := make([]serverDistance, 0, len(servers))
+	var missingCoords []string
+	for _, server := range servers {
+		coords, ok := cityCoordinatesByCode[server.CityCode]
+		if !ok {
+			missingCoords = append(missingCoords, server.CityCode)
+			continue
+		}
+		distances = append(distances, serverDistance{server, haversineKm(lat, lon, coords.Lat, coords.Lon)})
+	}
+	if len(missingCoords) > 0 {
+		log.Warn().
+			Int("servers", len(missingCoords)).
+			Strs("city_codes", dedupeStrings(missingCoords)).
+			Msg("Geo pre-filter has no bundled coordinates for some city codes; those servers were excluded from consideration")
+	}
+	sort.Slice(distances, func(i, j int) bool { return distances[i].distance < distances[j].distance })
+
+	if maxDistanceKm > 0 {
+		cut := len(distances)
+		for i, d := range distances {
+			if d.distance > maxDistanceKm {
+				cut = i
+				break
+			}
+		}
+		distances = distances[:cut]
+	}
+	if nearest > 0 && len(distances) > nearest {
+		distances = distances[:nearest]
+	}
+
+	filtered := make([]*MullvadServerDTO, len(distances))
+	for i, d := range distances {
+		filtered[i] = d.server
+	}
+	log.Debug().Int("candidates", len(filtered)).Msg("Applied geo pre-filter")
+	return filtered
+}
+
+func callerLocation() (lat, lon float64, err error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("https://am.i.mullvad.net/json")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	var payload struct {
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return 0, 0, err
+	}
+	return payload.Latitude, payload.Longitude, nil
+}
+
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKm = 6371.0
+	dLat := degToRad(lat2 - lat1)
+	dLon := degToRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(degToRad(lat1))*math.Cos(degToRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+	return earthRadiusKm * c
+}
+
+func degToRad(deg float64) float64 { return deg * math.Pi / 180 }
+
+// dedupeStrings returns the unique values in values, preserving first-seen order.
+func dedupeStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, v := range values {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		unique = append(unique, v)
+	}
+	return unique
+}
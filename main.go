@@ -4,18 +4,17 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/go-ping/ping"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/schollz/progressbar/v3"
 )
 
 type MullvadServerDTO struct {
@@ -37,16 +36,31 @@ type MullvadServerDTO struct {
 
 type MullvadServer struct {
 	MullvadServerDTO
-	Duration time.Duration
+	MinRTT time.Duration
+	AvgRTT time.Duration
+	MaxRTT time.Duration
+	Mdev   time.Duration
+	Loss   float64
 }
 
-type ByLatency []*MullvadServer
-
-func (a ByLatency) Len() int           { return len(a) }
-func (a ByLatency) Less(i, j int) bool { return a[i].Duration < a[j].Duration }
-func (a ByLatency) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+// sortKeys maps a --sort value to the MullvadServer field it compares.
+var sortKeys = map[string]func(s *MullvadServer) time.Duration{
+	"min":    func(s *MullvadServer) time.Duration { return s.MinRTT },
+	"avg":    func(s *MullvadServer) time.Duration { return s.AvgRTT },
+	"jitter": func(s *MullvadServer) time.Duration { return s.Mdev },
+}
 
-var ErrInvalidPing = fmt.Errorf("0s ping detected")
+func sortServers(servers []*MullvadServer, by string) {
+	if by == "loss" {
+		sort.Slice(servers, func(i, j int) bool { return servers[i].Loss < servers[j].Loss })
+		return
+	}
+	key, ok := sortKeys[by]
+	if !ok {
+		key = sortKeys["min"]
+	}
+	sort.Slice(servers, func(i, j int) bool { return key(servers[i]) < key(servers[j]) })
+}
 
 func main() {
 	var outputFlag = flag.String("o", "", "Output format. 'json' outputs server json")
@@ -55,6 +69,19 @@ func main() {
 	var topCountFlag = flag.String("s", "10", "Set custom limit for top latency servers output")
 	var typeFlag = flag.String("t", "wireguard", "Server type, e.g. wireguard")
 	var logLevel = flag.String("l", "info", "Log level. Allowed values: trace, debug, info, warn, error, fatal, panic")
+	var jobsFlag = flag.Int("j", runtime.NumCPU()*4, "Number of concurrent workers used to measure server latency")
+	var probeCountFlag = flag.Int("n", 5, "Number of ping probes sent per server")
+	var sortFlag = flag.String("sort", "min", "Sort servers by ping statistic. Allowed values: min, avg, jitter, loss")
+	var probeFlag = flag.String("probe", probeICMP, "Probe method used to measure latency. Allowed values: icmp, tcp, https")
+	var probePortFlag = flag.String("probe-port", defaultTCPProbePort, "Port dialed by the TCP probe (--probe=tcp or the ICMP fallback)")
+	var cacheTTLFlag = flag.String("cache-ttl", "24h", "How long to trust the cached relay list before refreshing, e.g. 24h")
+	var refreshFlag = flag.Bool("refresh", false, "Bypass the cache TTL and force a refresh from the Mullvad API")
+	var offlineFlag = flag.Bool("offline", false, "Require the cached relay list; never hit the network")
+	var nearestFlag = flag.Int("nearest", 0, "Only ping the N nearest relays by great-circle distance (0 disables)")
+	var maxDistanceKmFlag = flag.Float64("max-distance-km", 0, "Only ping relays within this many km of the caller (0 disables)")
+	var accountFlag = flag.String("account", "", "Mullvad account number, used by -o wgconf(-multihop). Falls back to MULLVAD_ACCOUNT")
+	var exitCountryFlag = flag.String("exit-country", "", "Exit country code for -o wgconf-multihop, e.g. us")
+	var verifyFlag = flag.Bool("verify", false, "After ranking, report whether the current Mullvad exit matches the recommended best server")
 	flag.Parse()
 
 	level, err := zerolog.ParseLevel(*logLevel)
@@ -68,13 +95,52 @@ func main() {
 		log.Fatal().Err(err).Msg("-s flag should not contain characters, only numbers")
 	}
 
-	servers := getServers(*typeFlag)
-	measuredServers, err := measureServersLatency(servers, *countryFlag, *excludeCountriesFlag)
+	if *jobsFlag < 1 {
+		log.Fatal().Msg("-j flag must be at least 1")
+	}
+	if *probeCountFlag < 1 {
+		log.Fatal().Msg("-n flag must be at least 1")
+	}
+	switch *probeFlag {
+	case probeICMP, probeTCP, probeHTTPS:
+	default:
+		log.Fatal().Str("probe", *probeFlag).Msg("--probe must be one of: icmp, tcp, https")
+	}
+	cacheTTL, err := time.ParseDuration(*cacheTTLFlag)
+	if err != nil {
+		log.Fatal().Err(err).Msg("--cache-ttl must be a valid duration, e.g. 24h")
+	}
+	if *offlineFlag && *refreshFlag {
+		log.Fatal().Msg("--offline and --refresh are mutually exclusive")
+	}
+
+	servers := getServers(*typeFlag, cacheTTL, *refreshFlag, *offlineFlag)
+	servers = filterEligibleServers(servers, *countryFlag, *excludeCountriesFlag)
+	servers = filterByGeoProximity(servers, *nearestFlag, *maxDistanceKmFlag)
+	measuredServers, err := measureServersLatency(servers, *jobsFlag, *probeCountFlag, *probeFlag, *probePortFlag)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to measure ping")
 	}
 
-	sort.Sort(ByLatency(measuredServers))
+	sortServers(measuredServers, *sortFlag)
+
+	if *outputFlag == "wgconf" || *outputFlag == "wgconf-multihop" {
+		emitWireGuardConfig(measuredServers, resolveAccountNumber(*accountFlag), *exitCountryFlag, *outputFlag == "wgconf-multihop")
+		return
+	}
+
+	if *verifyFlag {
+		report, err := verifyCurrentExit(measuredServers)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to verify current Mullvad exit")
+		} else {
+			reportJson, err := json.Marshal(report)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Couldn't marshal verify report to Json")
+			}
+			fmt.Println(string(reportJson))
+		}
+	}
 
 	if len(measuredServers) < topLimit {
 		topLimit = len(measuredServers)
@@ -83,7 +149,7 @@ func main() {
 		log.Debug().Interface("server", server).Msg("Best latency server found.")
 		hostname := strings.TrimSuffix(server.Hostname, "-wireguard")
 		if *outputFlag != "json" {
-			fmt.Printf("%s: %s\n", hostname, server.Duration.String())
+			fmt.Printf("%s: min=%s avg=%s mdev=%s loss=%.0f%%\n", hostname, server.MinRTT, server.AvgRTT, server.Mdev, server.Loss*100)
 		} else {
 			serverJson, err := json.Marshal(server)
 			if err != nil {
@@ -94,70 +160,65 @@ func main() {
 	}
 }
 
-func getServers(serverType string) (servers []*MullvadServerDTO) {
-	var responseBody []byte
-
-	resp, err := http.Get("https://api.mullvad.net/www/relays/" + serverType + "/")
-	if err != nil {
-		log.Error().Err(err).Msg("Mullvad API not responding, falling back to local server list backup")
-		responseBody, err = os.ReadFile("wireguard_servers.json")
-		if err != nil {
-			log.Fatal().Err(err).Msg("Can't find servers backup file")
-		}
-	} else {
-		responseBody, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to read the body")
-		}
-		defer resp.Body.Close()
-	}
-
-	err = json.Unmarshal(responseBody, &servers)
-	if err != nil {
-		log.Fatal().Err(err).Msg("couldn't unmarshall server json")
-	}
-	return
-}
-
-func measureServersLatency(servers []*MullvadServerDTO, country string, excludedCountriesStr string) (measuredServers []*MullvadServer, err error) {
+// filterEligibleServers drops inactive servers and applies the country
+// include/exclude filters. This must run before any pre-filtering (e.g. geo
+// proximity) that further narrows the candidate list, or a country's relays
+// can be discarded before the country filter ever sees them.
+func filterEligibleServers(servers []*MullvadServerDTO, country string, excludedCountriesStr string) []*MullvadServerDTO {
+	var eligible []*MullvadServerDTO
 	for _, server := range servers {
 		if (!server.Active) ||
 			server.CountryCode != country && country != "" ||
 			strings.Contains(excludedCountriesStr, server.CountryCode) {
 			continue
 		}
-		measuredServer, err := serverLatency(*server)
-		if err != nil {
-			log.Error().Err(err)
-			continue
-		}
-		measuredServers = append(measuredServers, measuredServer)
+		eligible = append(eligible, server)
 	}
-	return
+	return eligible
 }
 
-//goland:noinspection GoBoolExpressions
-func serverLatency(s MullvadServerDTO) (*MullvadServer, error) {
-	pinger, err := ping.NewPinger(s.Ipv4AddrIn)
-	pinger.Timeout = time.Second
-	if runtime.GOOS == "windows" {
-		pinger.SetPrivileged(true)
-	}
-	pinger.Count = 1
-	if err != nil {
-		return &MullvadServer{MullvadServerDTO: s, Duration: time.Second * 999}, err
-	}
-	var duration time.Duration
-	pinger.OnRecv = func(pkt *ping.Packet) {
-		log.Debug().Str("Server", s.Hostname).IPAddr("IP", pkt.IPAddr.IP).Dur("RTT", pkt.Rtt).Msg("Added server latency.")
-		duration = pkt.Rtt
+// measureServersLatency pings the given servers concurrently using a bounded
+// pool of `jobs` workers, reporting progress on stderr.
+func measureServersLatency(eligible []*MullvadServerDTO, jobs int, probeCount int, probeMode string, tcpProbePort string) (measuredServers []*MullvadServer, err error) {
+	jobsCh := make(chan *MullvadServerDTO, len(eligible))
+	resultsCh := make(chan *MullvadServer, len(eligible))
+
+	bar := progressbar.NewOptions(len(eligible),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionSetDescription("checking servers"),
+		progressbar.OptionShowCount(),
+		progressbar.OptionClearOnFinish(),
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for server := range jobsCh {
+				measuredServer, pingErr := serverLatency(*server, probeCount, probeMode, tcpProbePort)
+				_ = bar.Add(1)
+				if pingErr != nil {
+					log.Error().Err(pingErr).Str("server", server.Hostname).Msg("Skipping server")
+					continue
+				}
+				resultsCh <- measuredServer
+			}
+		}()
 	}
-	err = pinger.Run()
-	if err != nil {
-		return nil, err
+
+	for _, server := range eligible {
+		jobsCh <- server
 	}
-	if duration == 0 {
-		return nil, ErrInvalidPing
+	close(jobsCh)
+
+	go func() {
+		wg.Wait()
+		close(resultsCh)
+	}()
+
+	for measuredServer := range resultsCh {
+		measuredServers = append(measuredServers, measuredServer)
 	}
-	return &MullvadServer{MullvadServerDTO: s, Duration: duration}, err
+	return
 }
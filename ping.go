@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/go-ping/ping"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	probeICMP  = "icmp"
+	probeTCP   = "tcp"
+	probeHTTPS = "https"
+)
+
+// wireGuardPort is the port WireGuard relays accept tunnel traffic on; it's
+// used to build the [Peer] Endpoint in wgconf.go, not for TCP probing.
+const wireGuardPort = "51820"
+
+// defaultTCPProbePort is the port tcpLatency dials by default. Every Mullvad
+// relay terminates TLS on 443, which makes it a reliable TCP reachability
+// check even on networks that block ICMP and WireGuard's UDP port alike.
+const defaultTCPProbePort = "443"
+
+var ErrAllPacketsLost = fmt.Errorf("100%% packet loss")
+
+//goland:noinspection GoBoolExpressions
+func serverLatency(s MullvadServerDTO, probeCount int, probeMode string, tcpProbePort string) (*MullvadServer, error) {
+	switch probeMode {
+	case probeTCP:
+		return tcpLatency(s, probeCount, tcpProbePort)
+	case probeHTTPS:
+		return httpsLatency(s, probeCount)
+	default:
+		server, err := icmpLatency(s, probeCount)
+		if err != nil && runtime.GOOS != "windows" && isPermissionError(err) {
+			log.Warn().Str("server", s.Hostname).Msg("ICMP not permitted, falling back to TCP probe")
+			return tcpLatency(s, probeCount, tcpProbePort)
+		}
+		return server, err
+	}
+}
+
+func icmpLatency(s MullvadServerDTO, probeCount int) (*MullvadServer, error) {
+	pinger, err := ping.NewPinger(s.Ipv4AddrIn)
+	if err != nil {
+		return nil, err
+	}
+	pinger.Timeout = time.Duration(probeCount) * time.Second
+	if runtime.GOOS == "windows" {
+		pinger.SetPrivileged(true)
+	}
+	pinger.Count = probeCount
+	pinger.OnRecv = func(pkt *ping.Packet) {
+		log.Debug().Str("Server", s.Hostname).IPAddr("IP", pkt.IPAddr.IP).Dur("RTT", pkt.Rtt).Msg("Added server latency.")
+	}
+	err = pinger.Run()
+	if err != nil {
+		return nil, err
+	}
+	stats := pinger.Statistics()
+	if stats.PacketsRecv == 0 {
+		return nil, ErrAllPacketsLost
+	}
+	return &MullvadServer{
+		MullvadServerDTO: s,
+		MinRTT:           stats.MinRtt,
+		AvgRTT:           stats.AvgRtt,
+		MaxRTT:           stats.MaxRtt,
+		Mdev:             stats.StdDevRtt,
+		Loss:             stats.PacketLoss / 100,
+	}, nil
+}
+
+func isPermissionError(err error) bool {
+	return strings.Contains(err.Error(), "operation not permitted") || strings.Contains(err.Error(), "permission denied")
+}
+
+// tcpLatency measures TCP connect time against port, which defaults to 443
+// (every relay terminates TLS there) and doesn't require raw-socket
+// privileges like ICMP.
+func tcpLatency(s MullvadServerDTO, probeCount int, port string) (*MullvadServer, error) {
+	addr := net.JoinHostPort(s.Ipv4AddrIn, port)
+	durations := make([]time.Duration, 0, probeCount)
+	for i := 0; i < probeCount; i++ {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			log.Debug().Err(err).Str("server", s.Hostname).Msg("TCP probe failed")
+			continue
+		}
+		durations = append(durations, time.Since(start))
+		_ = conn.Close()
+	}
+	if len(durations) == 0 {
+		return nil, ErrAllPacketsLost
+	}
+	minRTT, avgRTT, maxRTT, mdev := durationStats(durations)
+	return &MullvadServer{
+		MullvadServerDTO: s,
+		MinRTT:           minRTT,
+		AvgRTT:           avgRTT,
+		MaxRTT:           maxRTT,
+		Mdev:             mdev,
+		Loss:             1 - float64(len(durations))/float64(probeCount),
+	}, nil
+}
+
+// httpsLatency measures the time to complete a TLS handshake against the
+// relay's HTTPS hostname, for networks where even the WireGuard port is
+// firewalled off but outbound 443 is open.
+func httpsLatency(s MullvadServerDTO, probeCount int) (*MullvadServer, error) {
+	hostname := strings.TrimSuffix(s.Hostname, "-wireguard")
+	url := "https://" + hostname + ".mullvad.net"
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = true
+	client := &http.Client{Timeout: time.Second * 5, Transport: transport}
+
+	durations := make([]time.Duration, 0, probeCount)
+	for i := 0; i < probeCount; i++ {
+		req, err := http.NewRequest(http.MethodHead, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		var handshakeStart time.Time
+		trace := &httptrace.ClientTrace{
+			TLSHandshakeStart: func() { handshakeStart = time.Now() },
+			TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+				if err == nil && !handshakeStart.IsZero() {
+					durations = append(durations, time.Since(handshakeStart))
+				}
+			},
+		}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Debug().Err(err).Str("server", s.Hostname).Msg("HTTPS probe failed")
+			continue
+		}
+		_ = resp.Body.Close()
+	}
+	if len(durations) == 0 {
+		return nil, ErrAllPacketsLost
+	}
+	minRTT, avgRTT, maxRTT, mdev := durationStats(durations)
+	return &MullvadServer{
+		MullvadServerDTO: s,
+		MinRTT:           minRTT,
+		AvgRTT:           avgRTT,
+		MaxRTT:           maxRTT,
+		Mdev:             mdev,
+		Loss:             1 - float64(len(durations))/float64(probeCount),
+	}, nil
+}
+
+// durationStats returns the min, average, max, and mean-deviation (mdev) of
+// a non-empty slice of durations.
+func durationStats(durations []time.Duration) (min, avg, max, mdev time.Duration) {
+	min, max = durations[0], durations[0]
+	var sum time.Duration
+	for _, d := range durations {
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+		sum += d
+	}
+	avg = sum / time.Duration(len(durations))
+
+	var devSum time.Duration
+	for _, d := range durations {
+		diff := d - avg
+		if diff < 0 {
+			diff = -diff
+		}
+		devSum += diff
+	}
+	mdev = devSum / time.Duration(len(durations))
+	return
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// amIMullvadResponse mirrors the fields we care about from
+// https://ipv4.am.i.mullvad.net/json (and its ipv6 counterpart).
+type amIMullvadResponse struct {
+	IP                    string `json:"ip"`
+	MullvadExitIP         bool   `json:"mullvad_exit_ip"`
+	MullvadExitIPHostname string `json:"mullvad_exit_ip_hostname"`
+}
+
+// verifyReport is the structured output of --verify.
+type verifyReport struct {
+	MullvadExitIP         string         `json:"mullvad_exit_ip"`
+	MullvadExitIPHostname string         `json:"mullvad_exit_ip_hostname"`
+	MullvadExitIPv6       string         `json:"mullvad_exit_ipv6,omitempty"`
+	IsMullvadExit         bool           `json:"is_mullvad_exit"`
+	MatchesBestServer     bool           `json:"matches_best_server"`
+	BestServerHostname    string         `json:"best_server_hostname"`
+	BestServerLatency     time.Duration  `json:"best_server_latency"`
+	CurrentExitLatency    *time.Duration `json:"current_exit_latency,omitempty"`
+	LatencyDelta          *time.Duration `json:"latency_delta,omitempty"`
+}
+
+// verifyCurrentExit queries am.i.mullvad.net to find out which server the
+// caller is currently tunneled through, then compares its latency against
+// the recommended best server out of the already-ranked servers.
+func verifyCurrentExit(servers []*MullvadServer) (*verifyReport, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no measured servers to compare against")
+	}
+
+	v4, v6 := checkBothAmIMullvad()
+	if v4 == nil {
+		return nil, fmt.Errorf("failed to query am.i.mullvad.net")
+	}
+
+	best := servers[0]
+	report := &verifyReport{
+		MullvadExitIP:         v4.IP,
+		MullvadExitIPHostname: v4.MullvadExitIPHostname,
+		IsMullvadExit:         v4.MullvadExitIP,
+		BestServerHostname:    strings.TrimSuffix(best.Hostname, "-wireguard"),
+		BestServerLatency:     best.MinRTT,
+	}
+	if v6 != nil {
+		report.MullvadExitIPv6 = v6.IP
+	}
+
+	for _, server := range servers {
+		if server.Ipv4AddrIn != v4.IP {
+			continue
+		}
+		latency := server.MinRTT
+		delta := latency - best.MinRTT
+		report.MatchesBestServer = server.Hostname == best.Hostname
+		report.CurrentExitLatency = &latency
+		report.LatencyDelta = &delta
+		break
+	}
+	return report, nil
+}
+
+// checkBothAmIMullvad queries the ipv4 and ipv6 am.i.mullvad.net endpoints
+// concurrently, the same way mullsox's CheckIP checks both stacks at once.
+func checkBothAmIMullvad() (v4 *amIMullvadResponse, v6 *amIMullvadResponse) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		resp, err := fetchAmIMullvad("https://ipv4.am.i.mullvad.net/json")
+		if err != nil {
+			log.Warn().Err(err).Msg("ipv4 am.i.mullvad.net check failed")
+			return
+		}
+		v4 = resp
+	}()
+	go func() {
+		defer wg.Done()
+		resp, err := fetchAmIMullvad("https://ipv6.am.i.mullvad.net/json")
+		if err != nil {
+			log.Debug().Err(err).Msg("ipv6 am.i.mullvad.net check failed")
+			return
+		}
+		v6 = resp
+	}()
+	wg.Wait()
+	return v4, v6
+}
+
+func fetchAmIMullvad(url string) (*amIMullvadResponse, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var payload amIMullvadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
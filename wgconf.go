@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/curve25519"
+)
+
+const accountAPIBaseURL = "https://api.mullvad.net/app/v1"
+
+type wireGuardKeyPair struct {
+	PrivateKey string
+	PublicKey  string
+}
+
+func generateWireGuardKeyPair() (*wireGuardKeyPair, error) {
+	var priv [32]byte
+	if _, err := rand.Read(priv[:]); err != nil {
+		return nil, err
+	}
+	priv[0] &= 248
+	priv[31] &= 127
+	priv[31] |= 64
+
+	pub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &wireGuardKeyPair{
+		PrivateKey: base64.StdEncoding.EncodeToString(priv[:]),
+		PublicKey:  base64.StdEncoding.EncodeToString(pub),
+	}, nil
+}
+
+type wireGuardAddresses struct {
+	Ipv4Address string `json:"ipv4_address"`
+	Ipv6Address string `json:"ipv6_address"`
+}
+
+// storedWireGuardKey is the on-disk record of the key pair generated for an
+// account, kept so subsequent runs reuse it instead of registering a new one
+// every time and burning through the account's key slot limit.
+type storedWireGuardKey struct {
+	Account    string `json:"account"`
+	PrivateKey string `json:"private_key"`
+	PublicKey  string `json:"public_key"`
+}
+
+func wireGuardKeyCachePath() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, "mullvad-best-server")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "wireguard-key.json"), nil
+}
+
+func loadStoredWireGuardKey(account string) (*wireGuardKeyPair, error) {
+	path, err := wireGuardKeyCachePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var stored storedWireGuardKey
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	if stored.Account != account {
+		return nil, fmt.Errorf("cached WireGuard key belongs to a different account")
+	}
+	return &wireGuardKeyPair{PrivateKey: stored.PrivateKey, PublicKey: stored.PublicKey}, nil
+}
+
+func saveStoredWireGuardKey(account string, keys *wireGuardKeyPair) error {
+	path, err := wireGuardKeyCachePath()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(storedWireGuardKey{Account: account, PrivateKey: keys.PrivateKey, PublicKey: keys.PublicKey})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// resolveWireGuardKey reuses the key pair cached for account if the account
+// API still accepts its public key, and only generates (and persists) a new
+// pair otherwise - e.g. on first use, or if the cached key was revoked.
+func resolveWireGuardKey(account string) (*wireGuardKeyPair, *wireGuardAddresses, error) {
+	if stored, err := loadStoredWireGuardKey(account); err == nil {
+		addrs, err := registerWireGuardKey(account, stored.PublicKey)
+		if err == nil {
+			return stored, addrs, nil
+		}
+		log.Warn().Err(err).Msg("Cached WireGuard key was rejected by the account API, generating a new one")
+	}
+
+	keys, err := generateWireGuardKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := registerWireGuardKey(account, keys.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := saveStoredWireGuardKey(account, keys); err != nil {
+		log.Warn().Err(err).Msg("Failed to persist WireGuard key for reuse")
+	}
+	return keys, addrs, nil
+}
+
+// registerWireGuardKey registers pubkey with the Mullvad account API and
+// returns the addresses assigned to it. Submitting an already-registered key
+// is a no-op on Mullvad's end, which is what lets resolveWireGuardKey reuse
+// a cached key without consuming another of the account's key slots.
+func registerWireGuardKey(account, pubkey string) (*wireGuardAddresses, error) {
+	payload, err := json.Marshal(map[string]string{"pubkey": pubkey})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, accountAPIBaseURL+"/wireguard-keys", strings.NewReader(string(payload)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+account)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("mullvad account API returned status %d", resp.StatusCode)
+	}
+
+	var addrs wireGuardAddresses
+	if err := json.NewDecoder(resp.Body).Decode(&addrs); err != nil {
+		return nil, err
+	}
+	return &addrs, nil
+}
+
+func resolveAccountNumber(accountFlag string) string {
+	if accountFlag != "" {
+		return accountFlag
+	}
+	return os.Getenv("MULLVAD_ACCOUNT")
+}
+
+// wireGuardConfig renders a ready-to-use config for entry. When exit is
+// non-nil, the peer is addressed through entry's MultihopPort so that
+// Mullvad's relays route the tunnel out via exit, per their multihop scheme.
+func wireGuardConfig(keys *wireGuardKeyPair, addrs *wireGuardAddresses, entry *MullvadServer, exit *MullvadServer) string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", keys.PrivateKey)
+	fmt.Fprintf(&b, "Address = %s/32, %s/128\n", addrs.Ipv4Address, addrs.Ipv6Address)
+	b.WriteString("DNS = 193.138.218.74\n\n")
+
+	b.WriteString("[Peer]\n")
+	if exit != nil {
+		fmt.Fprintf(&b, "# Multihop: entering via %s, exiting via %s\n", entry.Hostname, exit.Hostname)
+		fmt.Fprintf(&b, "PublicKey = %s\n", exit.Pubkey)
+		fmt.Fprintf(&b, "Endpoint = %s:%d\n", entry.Ipv4AddrIn, entry.MultihopPort)
+	} else {
+		fmt.Fprintf(&b, "PublicKey = %s\n", entry.Pubkey)
+		fmt.Fprintf(&b, "Endpoint = %s:%s\n", entry.Ipv4AddrIn, wireGuardPort)
+	}
+	b.WriteString("AllowedIPs = 0.0.0.0/0, ::/0\n")
+	return b.String()
+}
+
+// emitWireGuardConfig picks the best-ranked entry (and, for multihop, the
+// best-ranked relay in exitCountry) and prints a complete WireGuard
+// config for the given account to stdout.
+func emitWireGuardConfig(servers []*MullvadServer, account string, exitCountry string, multihop bool) {
+	if account == "" {
+		log.Fatal().Msg("wgconf output requires a Mullvad account number via --account or MULLVAD_ACCOUNT")
+	}
+	if len(servers) == 0 {
+		log.Fatal().Msg("No servers available to build a WireGuard config from")
+	}
+
+	entry := servers[0]
+	var exit *MullvadServer
+	if multihop {
+		if exitCountry == "" {
+			log.Fatal().Msg("wgconf-multihop requires --exit-country")
+		}
+		for _, server := range servers {
+			if server.CountryCode == exitCountry {
+				exit = server
+				break
+			}
+		}
+		if exit == nil {
+			log.Fatal().Str("country", exitCountry).Msg("No measured server found for the requested exit country")
+		}
+	}
+
+	keys, addrs, err := resolveWireGuardKey(account)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to register WireGuard key with Mullvad")
+	}
+
+	fmt.Println(wireGuardConfig(keys, addrs, entry, exit))
+}